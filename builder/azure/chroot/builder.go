@@ -51,9 +51,16 @@ type Config struct {
 	// is replaced with the command to be run. Defaults to `{{.Command}}`.
 	CommandWrapper string `mapstructure:"command_wrapper"`
 	// A series of commands to execute after attaching the root volume and before mounting the chroot.
-	// This is not required unless using `from_scratch`. If so, this should include any partitioning
-	// and filesystem creation commands. The path to the device is provided by `{{.Device}}`.
+	// This is not required unless using `from_scratch` without `disk_layout`. If so, this should include
+	// any partitioning commands. The path to the device is provided by `{{.Device}}`. When
+	// `luks_encryption` is enabled without `disk_layout`, do not create a filesystem here: `luks_encryption.filesystem` is
+	// created on the decrypted device after it has been LUKS-formatted and opened, which happens after
+	// these commands run, so anything created here would be overwritten.
 	PreMountCommands []string `mapstructure:"pre_mount_commands"`
+	// Structured partitioning and filesystem creation for `from_scratch` builds, as an alternative to
+	// hand-writing `sgdisk`/`mkfs` invocations in `pre_mount_commands`. See the
+	// [Disk Layout](#disk-layout) section below for more information.
+	DiskLayout DiskLayoutConfig `mapstructure:"disk_layout"`
 	// Options to supply the `mount` command when mounting devices. Each option will be prefixed with
 	// `-o` and supplied to the `mount` command ran by Packer. Because this command is ran in a shell,
 	// user discretion is advised. See this manual page for the `mount` command for valid file system specific options.
@@ -104,9 +111,50 @@ type Config struct {
 	// The shared image to create using this build.
 	SharedImageGalleryDestination SharedImageGalleryDestination `mapstructure:"shared_image_destination"`
 
+	// Enables LUKS2 full-disk encryption of the OS disk. See the
+	// [LUKS Encryption](#luks-encryption) section below for more information.
+	LuksEncryption LuksEncryptionConfig `mapstructure:"luks_encryption"`
+
+	// Builds an image for Azure Confidential VMs, whose LUKS-encrypted root
+	// filesystem is only unlockable after the guest attests to a remote key
+	// release service. See the [Confidential VM](#confidential-vm) section
+	// below for more information. Requires `luks_encryption` to be enabled.
+	ConfidentialVM ConfidentialVMConfig `mapstructure:"confidential_vm"`
+
 	ctx interpolate.Context
 }
 
+// hasBootMount reports whether chroot_mounts or disk_layout declares an
+// explicit mount for /boot, which from_scratch builds need to provide when using
+// confidential_vm so that the attested-unlock shim has somewhere
+// unencrypted to live.
+func (c *Config) hasBootMount() bool {
+	for _, m := range c.ChrootMounts {
+		if len(m) >= 3 && m[2] == "/boot" {
+			return true
+		}
+	}
+	for _, p := range c.DiskLayout.Partitions {
+		if p.Mountpoint == "/boot" {
+			return true
+		}
+	}
+	return false
+}
+
+// diskLayoutRootIsLuks reports whether the disk_layout partition mounted at
+// "/" has luks=true. confidential_vm needs this to be true so that
+// StepPartitionAndFormat puts 'luks_raw_device' in the stateBag for
+// StepGenerateWorkloadManifest to read.
+func (c *Config) diskLayoutRootIsLuks() bool {
+	for _, p := range c.DiskLayout.Partitions {
+		if p.Mountpoint == "/" {
+			return p.Luks
+		}
+	}
+	return false
+}
+
 type sourceType string
 
 const (
@@ -227,6 +275,29 @@ func (b *Builder) Prepare(raws ...interface{}) ([]string, []string, error) {
 		b.config.ImageHyperVGeneration = string(compute.V1)
 	}
 
+	if b.config.LuksEncryption.Enabled {
+		if b.config.LuksEncryption.Cipher == "" {
+			b.config.LuksEncryption.Cipher = "aes-xts-plain64"
+		}
+		if b.config.LuksEncryption.KeySize == 0 {
+			b.config.LuksEncryption.KeySize = 512
+		}
+		if b.config.LuksEncryption.Filesystem == "" {
+			b.config.LuksEncryption.Filesystem = "ext4"
+		}
+	}
+
+	if b.config.ConfidentialVM.Enabled {
+		// Confidential VM images require Hyper-V generation 2, which is
+		// forced here regardless of what was specified above. The OS disk
+		// SKU keeps its configured value and is checked against the
+		// CVM-capable SKUs below.
+		b.config.ImageHyperVGeneration = string(compute.V2)
+		if b.config.OSDiskStorageAccountType == "" {
+			b.config.OSDiskStorageAccountType = string(compute.PremiumLRS)
+		}
+	}
+
 	// checks, accumulate any errors or warnings
 
 	if b.config.FromScratch {
@@ -238,9 +309,31 @@ func (b *Builder) Prepare(raws ...interface{}) ([]string, []string, error) {
 			errs = packer.MultiErrorAppend(
 				errs, errors.New("os_disk_size_gb is required with from_scratch"))
 		}
-		if len(b.config.PreMountCommands) == 0 {
+		if len(b.config.PreMountCommands) == 0 && len(b.config.DiskLayout.Partitions) == 0 {
 			errs = packer.MultiErrorAppend(
-				errs, errors.New("pre_mount_commands is required with from_scratch"))
+				errs, errors.New("pre_mount_commands or disk_layout is required with from_scratch"))
+		}
+		if len(b.config.DiskLayout.Partitions) > 0 {
+			if err := b.config.DiskLayout.Validate(); err != nil {
+				errs = packer.MultiErrorAppend(errs, fmt.Errorf("disk_layout: %v", err))
+			}
+
+			hasLuksPartition := false
+			for _, p := range b.config.DiskLayout.Partitions {
+				if !p.Luks {
+					continue
+				}
+				hasLuksPartition = true
+				if !b.config.LuksEncryption.Enabled {
+					errs = packer.MultiErrorAppend(errs, fmt.Errorf(
+						"disk_layout: partition with mountpoint %q has luks=true but luks_encryption.enabled is false",
+						p.Mountpoint))
+				}
+			}
+			if b.config.LuksEncryption.Enabled && !hasLuksPartition {
+				errs = packer.MultiErrorAppend(errs, errors.New(
+					"luks_encryption.enabled is true but no disk_layout partition has luks=true; no partition will be encrypted"))
+			}
 		}
 	} else {
 		if _, err := client.ParsePlatformImageURN(b.config.Source); err == nil {
@@ -292,6 +385,33 @@ func (b *Builder) Prepare(raws ...interface{}) ([]string, []string, error) {
 		errs = packer.MultiErrorAppend(errs, fmt.Errorf("image_hyperv_generation: %v", err))
 	}
 
+	if b.config.LuksEncryption.Enabled {
+		if err := b.config.LuksEncryption.Validate(); err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("luks_encryption: %v", err))
+		}
+	}
+
+	if b.config.ConfidentialVM.Enabled {
+		if !b.config.LuksEncryption.Enabled {
+			errs = packer.MultiErrorAppend(errs, errors.New(
+				"confidential_vm requires luks_encryption to be enabled"))
+		}
+		if err := b.config.ConfidentialVM.Validate(); err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("confidential_vm: %v", err))
+		}
+		if err := checkConfidentialVMStorageAccountType(b.config.OSDiskStorageAccountType); err != nil {
+			errs = packer.MultiErrorAppend(errs, fmt.Errorf("os_disk_storage_account_type: %v", err))
+		}
+		if b.config.FromScratch && !b.config.hasBootMount() {
+			errs = packer.MultiErrorAppend(errs, errors.New(
+				"confidential_vm with from_scratch requires an explicit /boot entry in chroot_mounts or disk_layout"))
+		}
+		if len(b.config.DiskLayout.Partitions) > 0 && !b.config.diskLayoutRootIsLuks() {
+			errs = packer.MultiErrorAppend(errs, errors.New(
+				"confidential_vm requires the disk_layout partition with mountpoint \"/\" to have luks=true"))
+		}
+	}
+
 	if errs != nil {
 		return nil, warns, errs
 	}
@@ -320,6 +440,22 @@ func checkStorageAccountType(s string) interface{} {
 		s, compute.PossibleDiskStorageAccountTypesValues())
 }
 
+// confidentialVMStorageAccountTypes are the OS disk SKUs that support the
+// CVM-capable disk encryption sets required by confidential_vm.
+var confidentialVMStorageAccountTypes = []compute.DiskStorageAccountTypes{
+	compute.PremiumLRS,
+	compute.StandardSSDLRS,
+}
+
+func checkConfidentialVMStorageAccountType(s string) error {
+	for _, v := range confidentialVMStorageAccountTypes {
+		if compute.DiskStorageAccountTypes(s) == v {
+			return nil
+		}
+	}
+	return fmt.Errorf("%q is not a CVM-capable value %v", s, confidentialVMStorageAccountTypes)
+}
+
 func checkHyperVGeneration(s string) interface{} {
 	for _, v := range compute.PossibleHyperVGenerationValues() {
 		if compute.HyperVGeneration(s) == v {
@@ -474,16 +610,45 @@ func buildsteps(config Config, info *client.ComputeInfo) []multistep.Step {
 		}
 	}
 
-	addSteps(
-		&StepAttachDisk{}, // uses os_disk_resource_id and sets 'device' in stateBag
-		&chroot.StepPreMountCommands{
-			Commands: config.PreMountCommands,
-		},
-		&StepMountDevice{
+	addSteps(&StepAttachDisk{}) // uses os_disk_resource_id and sets 'device' in stateBag
+
+	hasDiskLayout := len(config.DiskLayout.Partitions) > 0
+	if hasDiskLayout {
+		// Partitions and formats the raw device before pre_mount_commands runs,
+		// so users no longer have to hand-write sgdisk/mkfs invocations there.
+		addSteps(&StepPartitionAndFormat{
+			Config:         config.DiskLayout,
+			LuksEncryption: config.LuksEncryption,
+		})
+	}
+
+	addSteps(&chroot.StepPreMountCommands{
+		Commands: config.PreMountCommands,
+	})
+
+	if config.LuksEncryption.Enabled && !hasDiskLayout {
+		// Formats and opens the raw device (or, with from_scratch, the partition
+		// named by wrap_partition) *after* pre_mount_commands has had a chance to
+		// partition it, then rewrites 'device' in the stateBag to the mapper path
+		// so every later step transparently operates on the decrypted block device.
+		// disk_layout handles its own per-partition LUKS formatting instead.
+		addSteps(&StepLuksFormat{Config: config.LuksEncryption})
+	}
+
+	if hasDiskLayout {
+		addSteps(&StepMountPartitions{
+			Config:    config.DiskLayout,
+			MountPath: config.MountPath,
+		})
+	} else {
+		addSteps(&StepMountDevice{
 			MountOptions:   config.MountOptions,
 			MountPartition: config.MountPartition,
 			MountPath:      config.MountPath,
-		},
+		})
+	}
+
+	addSteps(
 		&chroot.StepPostMountCommands{
 			Commands: config.PostMountCommands,
 		},
@@ -494,9 +659,29 @@ func buildsteps(config Config, info *client.ComputeInfo) []multistep.Step {
 			Files: config.CopyFiles,
 		},
 		&chroot.StepChrootProvision{},
-		&chroot.StepEarlyCleanup{},
 	)
 
+	if config.ConfidentialVM.Enabled {
+		// Writes the attested-unlock shim and its manifest into the chroot
+		// now that it's mounted and provisioned, but before the LUKS
+		// mapping used to provision it is closed.
+		addSteps(&StepGenerateWorkloadManifest{
+			Config:         config.ConfidentialVM,
+			LuksEncryption: config.LuksEncryption,
+		})
+	}
+
+	if hasDiskLayout {
+		// Unmounts the partitions (and closes any per-partition LUKS mappings)
+		// before StepEarlyCleanup detaches the temporary disk.
+		addSteps(&StepUnmountPartitions{Config: config.DiskLayout})
+	} else if config.LuksEncryption.Enabled {
+		// luksClose the mapper before StepEarlyCleanup detaches the temporary disk.
+		addSteps(&StepLuksClose{Config: config.LuksEncryption})
+	}
+
+	addSteps(&chroot.StepEarlyCleanup{})
+
 	if config.ImageResourceID != "" {
 		addSteps(&StepCreateImage{
 			ImageResourceID:          config.ImageResourceID,
@@ -519,6 +704,12 @@ func buildsteps(config Config, info *client.ComputeInfo) []multistep.Step {
 				Location:        info.Location,
 			},
 		)
+
+		if config.ConfidentialVM.Enabled {
+			addSteps(&StepTagConfidentialVMImageVersion{
+				Destination: config.SharedImageGalleryDestination,
+			})
+		}
 	}
 
 	return steps
@@ -0,0 +1,60 @@
+package chroot
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ConfidentialVMConfig describes how to build an image for Azure
+// Confidential VMs whose LUKS-encrypted root filesystem is only unlocked
+// after the guest successfully attests to a remote key release service.
+type ConfidentialVMConfig struct {
+	// Build a confidential VM image. Defaults to `false`. Requires
+	// `luks_encryption.enabled` to also be `true`.
+	Enabled bool `mapstructure:"enabled"`
+	// The URL of the attestation / key release service that the
+	// `attested-unlock` boot shim POSTs its quote to in exchange for the
+	// LUKS passphrase.
+	AttestationURL string `mapstructure:"attestation_url" required:"true"`
+	// An identifier for this image sent alongside the attestation quote,
+	// letting the attestation service pick the right wrapped passphrase out
+	// of the workload manifest.
+	WorkloadID string `mapstructure:"workload_id" required:"true"`
+	// The confidential computing technology the image targets. One of
+	// `SEV`, `SNP`, or `TDX`.
+	TeeType string `mapstructure:"teetype" required:"true"`
+	// A `file:` or `keyvault:` reference (see `luks_encryption.passphrase_source`
+	// for the syntax) to a PEM-encoded RSA public key belonging to the
+	// attestation server. The LUKS passphrase is encrypted to this key before
+	// being written into the workload manifest.
+	DiskEncryptionKeySource string `mapstructure:"disk_encryption_key_source" required:"true"`
+}
+
+var validTeeTypes = []string{"SEV", "SNP", "TDX"}
+
+// Validate checks that the ConfidentialVMConfig is internally consistent.
+// It should only be called when Enabled is true.
+func (c *ConfidentialVMConfig) Validate() error {
+	if c.AttestationURL == "" {
+		return fmt.Errorf("attestation_url is required")
+	}
+	if c.WorkloadID == "" {
+		return fmt.Errorf("workload_id is required")
+	}
+	if c.DiskEncryptionKeySource == "" {
+		return fmt.Errorf("disk_encryption_key_source is required")
+	}
+	if !strings.HasPrefix(c.DiskEncryptionKeySource, passphraseSourceFile) &&
+		!strings.HasPrefix(c.DiskEncryptionKeySource, passphraseSourceKeyVault) {
+		return fmt.Errorf(
+			"disk_encryption_key_source: %q must start with %q or %q",
+			c.DiskEncryptionKeySource, passphraseSourceFile, passphraseSourceKeyVault)
+	}
+
+	for _, t := range validTeeTypes {
+		if strings.EqualFold(c.TeeType, t) {
+			return nil
+		}
+	}
+	return fmt.Errorf("teetype: %q must be one of %v", c.TeeType, validTeeTypes)
+}
@@ -0,0 +1,49 @@
+package chroot
+
+import (
+	"context"
+
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/hashicorp/packer/builder/azure/common/client"
+)
+
+// tagGalleryImageVersionSecurityType sets an informational
+// SecurityType=ConfidentialVM tag on the shared image version that
+// StepCreateSharedImageVersion just created. This is a best-effort label for
+// operators and tooling browsing the version, not what makes it
+// CVM-deployable: that requires SecurityType to be set as a Features entry
+// on the gallery image (the definition the version belongs to, not the
+// version itself) when the gallery image is created, which is out of scope
+// for this builder and must be configured separately. The
+// "github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+// client this builder already uses does not expose that field.
+func tagGalleryImageVersionSecurityType(ctx context.Context, azcli client.AzureClientSet, destination SharedImageGalleryDestination) error {
+	id, err := azure.ParseResourceID(destination.ResourceID(azcli.SubscriptionID()))
+	if err != nil {
+		return err
+	}
+
+	galleryImageVersions := azcli.GalleryImageVersionsClient()
+
+	version, err := galleryImageVersions.Get(ctx,
+		id.ResourceGroup, id.ResourceName, id.ChildName1, id.ChildName2, "")
+	if err != nil {
+		return err
+	}
+
+	if version.Tags == nil {
+		version.Tags = map[string]*string{}
+	}
+	securityType := "ConfidentialVM"
+	version.Tags["SecurityType"] = &securityType
+
+	future, err := galleryImageVersions.Update(ctx,
+		id.ResourceGroup, id.ResourceName, id.ChildName1, id.ChildName2,
+		compute.GalleryImageVersionUpdate{Tags: version.Tags})
+	if err != nil {
+		return err
+	}
+
+	return future.WaitForCompletionRef(ctx, galleryImageVersions.Client)
+}
@@ -0,0 +1,68 @@
+package chroot
+
+import (
+	"fmt"
+
+	azcommon "github.com/hashicorp/packer/builder/azure/common"
+)
+
+// DiskLayoutConfig describes how a from_scratch disk should be partitioned
+// and formatted, as a structured alternative to hand-writing `sgdisk`/`mkfs`
+// invocations in pre_mount_commands.
+type DiskLayoutConfig struct {
+	// The partition table type: `gpt` or `mbr`. Defaults to `gpt`.
+	Type string `mapstructure:"type"`
+	// The partitions to create, in order.
+	Partitions []DiskPartition `mapstructure:"partitions"`
+}
+
+// DiskPartition describes a single partition of a disk_layout.
+type DiskPartition struct {
+	// The partition size: a number ending in `KiB`, `MiB`, `GiB`, or `TiB`
+	// (e.g. `200MiB`, `20GiB`), or exactly `100%` for "the rest of the disk".
+	// Other forms that `parted` accepts, such as `50%` or `1GB`, are rejected.
+	Size string `mapstructure:"size"`
+	// The filesystem to create on the partition: `ext4`, `xfs`, `btrfs`, or `vfat`.
+	Filesystem string `mapstructure:"filesystem"`
+	// The filesystem label.
+	Label string `mapstructure:"label"`
+	// Where the partition should be mounted in the chroot, e.g. `/`, `/boot`, `/boot/efi`.
+	Mountpoint string `mapstructure:"mountpoint"`
+	// Partition flags to set, as accepted by `parted`'s `set`, e.g. `esp`, `boot`.
+	Flags []string `mapstructure:"flags"`
+	// LUKS2-encrypt this partition before creating its filesystem. Uses the
+	// cipher, key size, and passphrase_source configured in `luks_encryption`.
+	Luks bool `mapstructure:"luks"`
+}
+
+var validPartitionTableTypes = []string{"gpt", "mbr"}
+var validPartitionFilesystems = []string{"ext4", "xfs", "btrfs", "vfat"}
+
+// Validate checks that the DiskLayoutConfig is internally consistent. It
+// should only be called when Partitions is non-empty.
+func (c *DiskLayoutConfig) Validate() error {
+	if c.Type == "" {
+		c.Type = "gpt"
+	}
+	if !azcommon.StringsContains(validPartitionTableTypes, c.Type) {
+		return fmt.Errorf("type: %q must be one of %v", c.Type, validPartitionTableTypes)
+	}
+
+	rootCount := 0
+	for i, p := range c.Partitions {
+		if p.Size == "" {
+			return fmt.Errorf("partitions[%d]: size is required", i)
+		}
+		if !azcommon.StringsContains(validPartitionFilesystems, p.Filesystem) {
+			return fmt.Errorf("partitions[%d]: filesystem %q must be one of %v", i, p.Filesystem, validPartitionFilesystems)
+		}
+		if p.Mountpoint == "/" {
+			rootCount++
+		}
+	}
+	if rootCount != 1 {
+		return fmt.Errorf("partitions: exactly one partition must have mountpoint \"/\", found %d", rootCount)
+	}
+
+	return nil
+}
@@ -0,0 +1,71 @@
+package chroot
+
+import (
+	"fmt"
+	"strings"
+
+	azcommon "github.com/hashicorp/packer/builder/azure/common"
+)
+
+// LuksEncryptionConfig describes how the OS disk of an azure-chroot build
+// should be encrypted with LUKS2 before the chroot environment is mounted
+// into it.
+type LuksEncryptionConfig struct {
+	// Encrypt the OS disk with LUKS2. Defaults to `false`.
+	Enabled bool `mapstructure:"enabled"`
+	// The cipher used to encrypt the disk, passed as `--cipher` to
+	// `cryptsetup luksFormat`. Defaults to `aes-xts-plain64`.
+	Cipher string `mapstructure:"cipher"`
+	// The key size, in bits, passed as `--key-size` to `cryptsetup luksFormat`.
+	// Defaults to `512`.
+	KeySize int `mapstructure:"key_size"`
+	// Where to read the encryption passphrase from. One of:
+	//   * `file:<path>` - read the passphrase from a file on the Packer VM.
+	//   * `keyvault:<vault name>/<secret name>` - read the passphrase from an
+	//     Azure Key Vault secret.
+	//   * `env:<var name>` - read the passphrase from an environment variable
+	//     on the Packer VM.
+	PassphraseSource string `mapstructure:"passphrase_source" required:"true"`
+	// If set, `cryptsetup luksFormat` writes a detached LUKS header to this
+	// path on the Packer VM instead of storing it at the start of the disk.
+	HeaderBackupPath string `mapstructure:"header_backup_path"`
+	// With `from_scratch`, the partition number of the raw device that should
+	// be LUKS-formatted and opened, leaving the rest of the disk (such as an
+	// unencrypted `/boot`) untouched. Defaults to operating on the whole disk.
+	WrapPartition string `mapstructure:"wrap_partition"`
+	// The filesystem to create on the device once it has been LUKS-formatted
+	// and opened: `ext4`, `xfs`, `btrfs`, or `vfat`. Defaults to `ext4`. Not
+	// used with `disk_layout`, which creates each partition's filesystem
+	// itself.
+	Filesystem string `mapstructure:"filesystem"`
+}
+
+const (
+	passphraseSourceFile     = "file:"
+	passphraseSourceKeyVault = "keyvault:"
+	passphraseSourceEnv      = "env:"
+)
+
+// Validate checks that the LuksEncryptionConfig is internally consistent.
+// It should only be called when Enabled is true.
+func (c *LuksEncryptionConfig) Validate() error {
+	if c.PassphraseSource == "" {
+		return fmt.Errorf("passphrase_source is required")
+	}
+
+	switch {
+	case strings.HasPrefix(c.PassphraseSource, passphraseSourceFile),
+		strings.HasPrefix(c.PassphraseSource, passphraseSourceKeyVault),
+		strings.HasPrefix(c.PassphraseSource, passphraseSourceEnv):
+	default:
+		return fmt.Errorf(
+			"passphrase_source: %q must start with %q, %q, or %q",
+			c.PassphraseSource, passphraseSourceFile, passphraseSourceKeyVault, passphraseSourceEnv)
+	}
+
+	if !azcommon.StringsContains(validPartitionFilesystems, c.Filesystem) {
+		return fmt.Errorf("filesystem: %q must be one of %v", c.Filesystem, validPartitionFilesystems)
+	}
+
+	return nil
+}
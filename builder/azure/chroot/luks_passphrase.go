@@ -0,0 +1,77 @@
+package chroot
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/hashicorp/packer/builder/azure/common/client"
+	"github.com/hashicorp/packer/helper/multistep"
+)
+
+// resolvePassphrase materializes the passphrase named by source (a
+// `file:`, `keyvault:`, or `env:` reference, see LuksEncryptionConfig) into a
+// local file that can be passed to `cryptsetup` as `--key-file`, and returns
+// its path.
+func resolvePassphrase(state multistep.StateBag, source string) (string, error) {
+	switch {
+	case strings.HasPrefix(source, passphraseSourceFile):
+		return strings.TrimPrefix(source, passphraseSourceFile), nil
+
+	case strings.HasPrefix(source, passphraseSourceEnv):
+		varName := strings.TrimPrefix(source, passphraseSourceEnv)
+		value, ok := os.LookupEnv(varName)
+		if !ok {
+			return "", fmt.Errorf("environment variable %q is not set", varName)
+		}
+		return writePassphraseFile(value)
+
+	case strings.HasPrefix(source, passphraseSourceKeyVault):
+		ref := strings.TrimPrefix(source, passphraseSourceKeyVault)
+		parts := strings.SplitN(ref, "/", 2)
+		if len(parts) != 2 {
+			return "", fmt.Errorf("keyvault reference %q must be of the form vaultname/secretname", ref)
+		}
+
+		azcli := state.Get("azureclient").(client.AzureClientSet)
+		value, err := azcli.KeyVaultClient().GetSecret(parts[0], parts[1])
+		if err != nil {
+			return "", fmt.Errorf("error reading secret %q from vault %q: %s", parts[1], parts[0], err)
+		}
+		return writePassphraseFile(value)
+
+	default:
+		return "", fmt.Errorf("unrecognized passphrase_source %q", source)
+	}
+}
+
+// removeResolvedPassphraseFile removes the file resolvePassphrase returned
+// for path, once the caller is done passing it to cryptsetup — but only if
+// it was materialized by writePassphraseFile. A `file:` source points at a
+// file the user owns, which must be left alone.
+func removeResolvedPassphraseFile(path, source string) {
+	if strings.HasPrefix(source, passphraseSourceFile) {
+		return
+	}
+	os.Remove(path)
+}
+
+// writePassphraseFile writes value to a private temp file and returns its
+// path, for passphrase sources that aren't already files on disk.
+func writePassphraseFile(value string) (string, error) {
+	f, err := ioutil.TempFile("", "packer-luks-passphrase-")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if err := f.Chmod(0600); err != nil {
+		return "", err
+	}
+	if _, err := f.WriteString(value); err != nil {
+		return "", err
+	}
+
+	return f.Name(), nil
+}
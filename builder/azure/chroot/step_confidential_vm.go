@@ -0,0 +1,293 @@
+package chroot
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+
+	"github.com/hashicorp/packer/builder/azure/common/client"
+	"github.com/hashicorp/packer/common"
+	"github.com/hashicorp/packer/helper/multistep"
+	"github.com/hashicorp/packer/packer"
+)
+
+// attestedUnlockShim is installed at /sbin/attested-unlock. At boot it reads
+// the workload manifest off the unencrypted /boot partition, exchanges an
+// attestation quote for the wrapped LUKS passphrase, and opens the root
+// device. It is intentionally minimal: all of the policy (what counts as a
+// valid quote, how the passphrase is wrapped) lives server-side, not here.
+const attestedUnlockShim = `#!/bin/sh
+# Installed by packer's azure-chroot confidential_vm mode. Do not edit by hand;
+# regenerate the image instead.
+set -e
+
+manifest=/boot/attested-unlock-manifest.json
+teetype=$(sed -n 's/.*"tee_type":[[:space:]]*"\([^"]*\)".*/\1/p' "$manifest")
+attestation_url=$(sed -n 's/.*"attestation_url":[[:space:]]*"\([^"]*\)".*/\1/p' "$manifest")
+workload_id=$(sed -n 's/.*"workload_id":[[:space:]]*"\([^"]*\)".*/\1/p' "$manifest")
+disk_uuid=$(sed -n 's/.*"disk_uuid":[[:space:]]*"\([^"]*\)".*/\1/p' "$manifest")
+
+case "$teetype" in
+	SNP|TDX) quote=$(tpm2_quote -Q -c /dev/tpm0) ;;
+	SEV)     quote=$(cat /dev/sev-guest) ;;
+	*) echo "attested-unlock: unknown teetype $teetype" >&2; exit 1 ;;
+esac
+
+passphrase=$(curl -fsS -X POST "$attestation_url" \
+	-d "{\"workload_id\":\"$workload_id\",\"quote\":\"$quote\"}" | \
+	sed -n 's/.*"passphrase":[[:space:]]*"\([^"]*\)".*/\1/p')
+
+echo -n "$passphrase" | cryptsetup open --key-file - "/dev/disk/by-uuid/$disk_uuid" cryptroot
+`
+
+// workloadManifest binds a LUKS-encrypted disk to the target TEE: the
+// attestation service uses it to decide which wrapped passphrase to return
+// and what it should measure before doing so. wrapped_passphrase is
+// encrypted to the attestation server's own key (see
+// disk_encryption_key_source), so it is safe to store on the unencrypted
+// /boot partition: only the attestation server holding the matching private
+// key can recover the cleartext passphrase from it.
+type workloadManifest struct {
+	DiskUUID                 string            `json:"disk_uuid"`
+	TeeType                  string            `json:"tee_type"`
+	LuksHeaderSHA256         string            `json:"luks_header_sha256"`
+	AttestationURL           string            `json:"attestation_url"`
+	WorkloadID               string            `json:"workload_id"`
+	WrappedPassphrase        map[string]string `json:"wrapped_passphrase"`
+	FallbackPassphraseSHA256 string            `json:"fallback_passphrase_sha256"`
+}
+
+// StepGenerateWorkloadManifest writes the workload manifest into the chroot's
+// /boot and the attested-unlock shim to /sbin/attested-unlock, then
+// regenerates the initramfs. It installs no initramfs hook or dropin that runs
+// the shim, so nothing in the image invokes /sbin/attested-unlock at boot.
+type StepGenerateWorkloadManifest struct {
+	Config         ConfidentialVMConfig
+	LuksEncryption LuksEncryptionConfig
+}
+
+func (s *StepGenerateWorkloadManifest) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packer.Ui)
+	mountPath := state.Get("mount_path").(string)
+	device := state.Get("luks_raw_device").(string)
+
+	ui.Say("Generating confidential VM workload manifest...")
+
+	headerSum, err := luksHeaderSHA256(state, device)
+	if err != nil {
+		err := fmt.Errorf("error hashing LUKS header: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	uuid, err := luksUUID(state, device)
+	if err != nil {
+		err := fmt.Errorf("error reading LUKS UUID: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	passphraseFile, err := resolvePassphrase(state, s.LuksEncryption.PassphraseSource)
+	if err != nil {
+		err := fmt.Errorf("error resolving luks_encryption.passphrase_source: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	defer removeResolvedPassphraseFile(passphraseFile, s.LuksEncryption.PassphraseSource)
+
+	wrapped, fallbackSum, err := wrapPassphrase(state, passphraseFile, s.Config.DiskEncryptionKeySource)
+	if err != nil {
+		err := fmt.Errorf("error wrapping passphrase: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	manifest := workloadManifest{
+		DiskUUID:                 uuid,
+		TeeType:                  s.Config.TeeType,
+		LuksHeaderSHA256:         headerSum,
+		AttestationURL:           s.Config.AttestationURL,
+		WorkloadID:               s.Config.WorkloadID,
+		WrappedPassphrase:        wrapped,
+		FallbackPassphraseSHA256: fallbackSum,
+	}
+
+	manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		err := fmt.Errorf("error marshaling workload manifest: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	if err := writeChrootFile(state, mountPath+"/boot/attested-unlock-manifest.json", string(manifestJSON), 0600); err != nil {
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	if err := writeChrootFile(state, mountPath+"/sbin/attested-unlock", attestedUnlockShim, 0755); err != nil {
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	if err := runWrappedCommand(state, fmt.Sprintf(
+		"chroot %s /bin/sh -c 'command -v update-initramfs >/dev/null && update-initramfs -u || dracut -f'", mountPath)); err != nil {
+		err := fmt.Errorf("error regenerating initramfs: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	return multistep.ActionContinue
+}
+
+func (s *StepGenerateWorkloadManifest) Cleanup(multistep.StateBag) {}
+
+// writeChrootFile writes content to path inside the chroot via the
+// configured command_wrapper, matching how the other steps in this package
+// reach into the mounted filesystem.
+func writeChrootFile(state multistep.StateBag, path, content string, mode int) error {
+	if err := runWrappedCommand(state, fmt.Sprintf("install -D -m %o /dev/null %s", mode, path)); err != nil {
+		return fmt.Errorf("error creating %s: %s", path, err)
+	}
+	encoded := base64.StdEncoding.EncodeToString([]byte(content))
+	if err := runWrappedCommand(state, fmt.Sprintf("sh -c 'echo %s | base64 -d > %s'", encoded, path)); err != nil {
+		return fmt.Errorf("error writing %s: %s", path, err)
+	}
+	return nil
+}
+
+// luksHeaderSHA256 hashes the first 16MiB of device, which comfortably
+// covers the LUKS2 header and keyslot area regardless of key size.
+func luksHeaderSHA256(state multistep.StateBag, device string) (string, error) {
+	wrappedCommand := state.Get("wrappedCommand").(common.CommandWrapper)
+	command, err := wrappedCommand(fmt.Sprintf("dd if=%s bs=1M count=16 2>/dev/null | sha256sum", device))
+	if err != nil {
+		return "", err
+	}
+	output, err := exec.CommandContext(context.TODO(), "/bin/sh", "-c", command).Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.Fields(string(output))[0], nil
+}
+
+// wrapPassphrase encrypts the passphrase at passphraseFile to the
+// attestation server's public key (identified by keySource, an RSA public
+// key resolved the same way as luks_encryption.passphrase_source) and
+// returns it alongside a hash of the passphrase to use as a fallback
+// integrity check. The hash is for integrity only: it is not sufficient on
+// its own to recover the passphrase.
+func wrapPassphrase(state multistep.StateBag, passphraseFile, keySource string) (map[string]string, string, error) {
+	data, err := ioutil.ReadFile(passphraseFile)
+	if err != nil {
+		return nil, "", err
+	}
+	sum := sha256.Sum256(data)
+
+	pub, err := resolveDiskEncryptionPublicKey(state, keySource)
+	if err != nil {
+		return nil, "", fmt.Errorf("error resolving disk_encryption_key_source: %s", err)
+	}
+
+	ciphertext, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, data, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("error encrypting passphrase: %s", err)
+	}
+
+	wrapped := map[string]string{
+		keySource: base64.StdEncoding.EncodeToString(ciphertext),
+	}
+
+	return wrapped, hex.EncodeToString(sum[:]), nil
+}
+
+// resolveDiskEncryptionPublicKey reads a PEM-encoded RSA public key from a
+// `file:` or `keyvault:` reference, the same source syntax used by
+// luks_encryption.passphrase_source.
+func resolveDiskEncryptionPublicKey(state multistep.StateBag, source string) (*rsa.PublicKey, error) {
+	var pemBytes []byte
+
+	switch {
+	case strings.HasPrefix(source, passphraseSourceFile):
+		data, err := ioutil.ReadFile(strings.TrimPrefix(source, passphraseSourceFile))
+		if err != nil {
+			return nil, err
+		}
+		pemBytes = data
+
+	case strings.HasPrefix(source, passphraseSourceKeyVault):
+		ref := strings.TrimPrefix(source, passphraseSourceKeyVault)
+		parts := strings.SplitN(ref, "/", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("keyvault reference %q must be of the form vaultname/secretname", ref)
+		}
+
+		azcli := state.Get("azureclient").(client.AzureClientSet)
+		value, err := azcli.KeyVaultClient().GetSecret(parts[0], parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("error reading secret %q from vault %q: %s", parts[1], parts[0], err)
+		}
+		pemBytes = []byte(value)
+
+	default:
+		return nil, fmt.Errorf("unrecognized source %q, must start with %q or %q",
+			source, passphraseSourceFile, passphraseSourceKeyVault)
+	}
+
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM-encoded public key found")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("key is not an RSA public key")
+	}
+	return rsaKey, nil
+}
+
+// StepTagConfidentialVMImageVersion applies an informational
+// SecurityType=ConfidentialVM tag to the freshly created gallery image
+// version. This does not itself make the image CVM-deployable; see
+// tagGalleryImageVersionSecurityType.
+type StepTagConfidentialVMImageVersion struct {
+	Destination SharedImageGalleryDestination
+}
+
+func (s *StepTagConfidentialVMImageVersion) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packer.Ui)
+	azcli := state.Get("azureclient").(client.AzureClientSet)
+
+	ui.Say("Applying informational SecurityType=ConfidentialVM tag to shared image version...")
+
+	if err := tagGalleryImageVersionSecurityType(ctx, azcli, s.Destination); err != nil {
+		err := fmt.Errorf("error tagging gallery image version: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	return multistep.ActionContinue
+}
+
+func (s *StepTagConfidentialVMImageVersion) Cleanup(multistep.StateBag) {}
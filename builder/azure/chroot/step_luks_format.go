@@ -0,0 +1,194 @@
+package chroot
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/hashicorp/packer/common"
+	"github.com/hashicorp/packer/helper/multistep"
+	"github.com/hashicorp/packer/packer"
+)
+
+// runWrappedCommand renders `command` through the configured command_wrapper
+// and runs it via the shell, streaming output to the UI. It mirrors the way
+// the other chroot steps shell out to host tools such as `parted` or `mkfs`.
+func runWrappedCommand(state multistep.StateBag, command string) error {
+	wrappedCommand := state.Get("wrappedCommand").(common.CommandWrapper)
+	ui := state.Get("ui").(packer.Ui)
+
+	command, err := wrappedCommand(command)
+	if err != nil {
+		return fmt.Errorf("error generating command: %s", err)
+	}
+
+	ui.Say(fmt.Sprintf("Executing: %s", command))
+	cmd := exec.CommandContext(context.TODO(), "/bin/sh", "-c", command)
+	output, err := cmd.CombinedOutput()
+	if len(output) > 0 {
+		ui.Message(string(output))
+	}
+	if err != nil {
+		return fmt.Errorf("error running %q: %s", command, err)
+	}
+	return nil
+}
+
+// luksDevice returns the raw block device that should be LUKS-formatted: the
+// whole disk, or, when wrap_partition is set, a single partition of it.
+func luksDevice(device, wrapPartition string) string {
+	if wrapPartition == "" {
+		return device
+	}
+	return devicePartitionPath(device, wrapPartition)
+}
+
+// devicePartitionPath builds the partition device path for a disk, handling
+// the `p` infix that nvme/mmcblk-style device names require (e.g.
+// /dev/nvme0n1 -> /dev/nvme0n1p1) versus plain numeric suffixes
+// (/dev/sdc -> /dev/sdc1).
+func devicePartitionPath(device, partition string) string {
+	last := device[len(device)-1]
+	if last >= '0' && last <= '9' {
+		return device + "p" + partition
+	}
+	return device + partition
+}
+
+// luksMapperName derives a deterministic device-mapper name from the device
+// path, so repeated builds against the same disk reuse the same name.
+func luksMapperName(device string) string {
+	return "packer-luks-" + strings.ReplaceAll(strings.TrimPrefix(device, "/dev/"), "/", "-")
+}
+
+// StepLuksFormat LUKS2-formats and opens the OS disk (or, with from_scratch
+// and wrap_partition, a single partition of it), creates
+// Config.Filesystem on the decrypted mapper device, and rewrites 'device'
+// in the stateBag so that every subsequent step mounts the decrypted,
+// formatted device instead of the raw one.
+type StepLuksFormat struct {
+	Config LuksEncryptionConfig
+
+	mapperName string
+}
+
+func (s *StepLuksFormat) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packer.Ui)
+	device := state.Get("device").(string)
+
+	ui.Say("Formatting device with LUKS2 encryption...")
+
+	rawDevice := luksDevice(device, s.Config.WrapPartition)
+	s.mapperName = luksMapperName(rawDevice)
+
+	passphraseFile, err := resolvePassphrase(state, s.Config.PassphraseSource)
+	if err != nil {
+		err := fmt.Errorf("error resolving luks_encryption.passphrase_source: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+	defer removeResolvedPassphraseFile(passphraseFile, s.Config.PassphraseSource)
+
+	formatArgs := fmt.Sprintf(
+		"cryptsetup luksFormat --type luks2 --cipher %s --key-size %d --batch-mode %s",
+		s.Config.Cipher, s.Config.KeySize, rawDevice)
+	if s.Config.HeaderBackupPath != "" {
+		formatArgs += fmt.Sprintf(" --header %s", s.Config.HeaderBackupPath)
+	}
+	formatArgs += fmt.Sprintf(" --key-file %s", passphraseFile)
+
+	if err := runWrappedCommand(state, formatArgs); err != nil {
+		err := fmt.Errorf("error running cryptsetup luksFormat: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	openArgs := fmt.Sprintf("cryptsetup luksOpen %s %s --key-file %s", rawDevice, s.mapperName, passphraseFile)
+	if s.Config.HeaderBackupPath != "" {
+		openArgs = fmt.Sprintf("cryptsetup luksOpen --header %s %s %s --key-file %s",
+			s.Config.HeaderBackupPath, rawDevice, s.mapperName, passphraseFile)
+	}
+
+	if err := runWrappedCommand(state, openArgs); err != nil {
+		err := fmt.Errorf("error running cryptsetup luksOpen: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	mapperPath := "/dev/mapper/" + s.mapperName
+
+	ui.Say(fmt.Sprintf("Creating %s filesystem on %s...", s.Config.Filesystem, mapperPath))
+	if err := runWrappedCommand(state, fmt.Sprintf("mkfs.%s %s", s.Config.Filesystem, mapperPath)); err != nil {
+		err := fmt.Errorf("error creating filesystem: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	uuid, err := luksUUID(state, rawDevice)
+	if err != nil {
+		err := fmt.Errorf("error reading LUKS UUID: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	if genData, ok := state.GetOk("generated_data"); ok {
+		generatedData := genData.(map[string]interface{})
+		generatedData["LuksUUID"] = uuid
+	}
+
+	// luks_raw_device keeps the underlying LUKS container around for steps
+	// that need to address the container itself (luksUUID, header hashing),
+	// as opposed to 'device', which every other step treats as the block
+	// device to mount and is now the decrypted mapper.
+	state.Put("luks_raw_device", rawDevice)
+	state.Put("device", mapperPath)
+
+	return multistep.ActionContinue
+}
+
+func (s *StepLuksFormat) Cleanup(multistep.StateBag) {
+	// luksClose happens in StepLuksClose, explicitly sequenced before
+	// StepEarlyCleanup detaches the disk, rather than here.
+}
+
+func luksUUID(state multistep.StateBag, device string) (string, error) {
+	wrappedCommand := state.Get("wrappedCommand").(common.CommandWrapper)
+	command, err := wrappedCommand(fmt.Sprintf("cryptsetup luksUUID %s", device))
+	if err != nil {
+		return "", err
+	}
+	output, err := exec.CommandContext(context.TODO(), "/bin/sh", "-c", command).Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// StepLuksClose closes the device-mapper mapping opened by StepLuksFormat.
+type StepLuksClose struct {
+	Config LuksEncryptionConfig
+}
+
+func (s *StepLuksClose) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packer.Ui)
+	mapperPath := state.Get("device").(string)
+	mapperName := strings.TrimPrefix(mapperPath, "/dev/mapper/")
+
+	ui.Say("Closing LUKS device...")
+	if err := runWrappedCommand(state, fmt.Sprintf("cryptsetup luksClose %s", mapperName)); err != nil {
+		err := fmt.Errorf("error running cryptsetup luksClose: %s", err)
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	return multistep.ActionContinue
+}
+
+func (s *StepLuksClose) Cleanup(multistep.StateBag) {}
@@ -0,0 +1,299 @@
+package chroot
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/packer/helper/multistep"
+	"github.com/hashicorp/packer/packer"
+	"github.com/hashicorp/packer/template/interpolate"
+)
+
+// StepPartitionAndFormat partitions the raw, attached disk according to
+// Config and creates the requested filesystem on each partition, so that
+// from_scratch builds no longer need hand-written sgdisk/mkfs invocations in
+// pre_mount_commands.
+type StepPartitionAndFormat struct {
+	Config         DiskLayoutConfig
+	LuksEncryption LuksEncryptionConfig
+}
+
+func (s *StepPartitionAndFormat) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packer.Ui)
+	device := state.Get("device").(string)
+
+	ui.Say(fmt.Sprintf("Partitioning %s (%s)...", device, s.Config.Type))
+
+	label := "gpt"
+	if s.Config.Type == "mbr" {
+		label = "msdos"
+	}
+	if err := runWrappedCommand(state, fmt.Sprintf("parted -s %s mklabel %s", device, label)); err != nil {
+		return s.halt(state, fmt.Errorf("error creating partition table: %s", err))
+	}
+
+	partitionDevices := map[string]string{}
+	var luksMappers []string
+
+	offsetMiB := 1
+	for i, p := range s.Config.Partitions {
+		partNum := i + 1
+		partDevice := devicePartitionPath(device, strconv.Itoa(partNum))
+
+		startEnd, newOffset, err := partitionBounds(offsetMiB, p.Size)
+		if err != nil {
+			return s.halt(state, fmt.Errorf("partitions[%d]: %s", i, err))
+		}
+		offsetMiB = newOffset
+
+		ui.Say(fmt.Sprintf("Creating partition %d (%s, %s)...", partNum, p.Size, p.Mountpoint))
+		if err := runWrappedCommand(state, fmt.Sprintf("parted -s %s mkpart primary %s", device, startEnd)); err != nil {
+			return s.halt(state, fmt.Errorf("error creating partition %d: %s", partNum, err))
+		}
+
+		for _, flag := range p.Flags {
+			if err := runWrappedCommand(state, fmt.Sprintf("parted -s %s set %d %s on", device, partNum, flag)); err != nil {
+				return s.halt(state, fmt.Errorf("error setting flag %q on partition %d: %s", flag, partNum, err))
+			}
+		}
+
+		if err := runWrappedCommand(state, fmt.Sprintf("partprobe %s", device)); err != nil {
+			return s.halt(state, fmt.Errorf("error re-reading partition table: %s", err))
+		}
+		if err := runWrappedCommand(state, "udevadm settle"); err != nil {
+			return s.halt(state, fmt.Errorf("error waiting for udev: %s", err))
+		}
+
+		mkfsTarget := partDevice
+		if p.Luks {
+			mapperName := luksMapperName(partDevice)
+			if err := s.formatLuksPartition(state, partDevice, mapperName); err != nil {
+				return s.halt(state, err)
+			}
+			mkfsTarget = "/dev/mapper/" + mapperName
+			luksMappers = append(luksMappers, mapperName)
+
+			if p.Mountpoint == "/" {
+				state.Put("luks_raw_device", partDevice)
+			}
+		}
+
+		mkfsArgs := fmt.Sprintf("mkfs.%s", p.Filesystem)
+		if p.Label != "" {
+			switch p.Filesystem {
+			case "vfat":
+				mkfsArgs += fmt.Sprintf(" -n %s", p.Label)
+			default:
+				mkfsArgs += fmt.Sprintf(" -L %s", p.Label)
+			}
+		}
+		if err := runWrappedCommand(state, fmt.Sprintf("%s %s", mkfsArgs, mkfsTarget)); err != nil {
+			return s.halt(state, fmt.Errorf("error formatting partition %d: %s", partNum, err))
+		}
+
+		partitionDevices[p.Mountpoint] = mkfsTarget
+		if p.Mountpoint == "/" {
+			state.Put("device", mkfsTarget)
+		}
+	}
+
+	state.Put("disk_layout_partition_devices", partitionDevices)
+	state.Put("disk_layout_luks_mappers", luksMappers)
+
+	return multistep.ActionContinue
+}
+
+func (s *StepPartitionAndFormat) formatLuksPartition(state multistep.StateBag, partDevice, mapperName string) error {
+	passphraseFile, err := resolvePassphrase(state, s.LuksEncryption.PassphraseSource)
+	if err != nil {
+		return fmt.Errorf("error resolving luks_encryption.passphrase_source: %s", err)
+	}
+	defer removeResolvedPassphraseFile(passphraseFile, s.LuksEncryption.PassphraseSource)
+
+	formatArgs := fmt.Sprintf(
+		"cryptsetup luksFormat --type luks2 --cipher %s --key-size %d --batch-mode %s --key-file %s",
+		s.LuksEncryption.Cipher, s.LuksEncryption.KeySize, partDevice, passphraseFile)
+	if err := runWrappedCommand(state, formatArgs); err != nil {
+		return fmt.Errorf("error running cryptsetup luksFormat on %s: %s", partDevice, err)
+	}
+
+	openArgs := fmt.Sprintf("cryptsetup luksOpen %s %s --key-file %s", partDevice, mapperName, passphraseFile)
+	if err := runWrappedCommand(state, openArgs); err != nil {
+		return fmt.Errorf("error running cryptsetup luksOpen on %s: %s", partDevice, err)
+	}
+
+	return nil
+}
+
+func (s *StepPartitionAndFormat) halt(state multistep.StateBag, err error) multistep.StepAction {
+	ui := state.Get("ui").(packer.Ui)
+	state.Put("error", err)
+	ui.Error(err.Error())
+	return multistep.ActionHalt
+}
+
+func (s *StepPartitionAndFormat) Cleanup(multistep.StateBag) {}
+
+// partitionBounds returns the `parted mkpart` start/end arguments for a
+// partition of the given size starting at offsetMiB, and the offset the
+// next partition should start at. "100%" sizes run to the end of the disk.
+func partitionBounds(offsetMiB int, size string) (string, int, error) {
+	if size == "100%" {
+		return fmt.Sprintf("%dMiB 100%%", offsetMiB), -1, nil
+	}
+
+	sizeMiB, err := parseSizeMiB(size)
+	if err != nil {
+		return "", 0, err
+	}
+
+	end := offsetMiB + sizeMiB
+	return fmt.Sprintf("%dMiB %dMiB", offsetMiB, end), end, nil
+}
+
+// parseSizeMiB parses sizes of the form "200MiB", "20GiB", or "512KiB" into
+// a number of mebibytes.
+func parseSizeMiB(size string) (int, error) {
+	suffixes := map[string]float64{
+		"KiB": 1.0 / 1024,
+		"MiB": 1,
+		"GiB": 1024,
+		"TiB": 1024 * 1024,
+	}
+	for suffix, mult := range suffixes {
+		if strings.HasSuffix(size, suffix) {
+			n, err := strconv.ParseFloat(strings.TrimSuffix(size, suffix), 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid size %q: %s", size, err)
+			}
+			return int(n * mult), nil
+		}
+	}
+	return 0, fmt.Errorf("size %q must end in KiB, MiB, GiB, TiB, or be \"100%%\"", size)
+}
+
+// StepMountPartitions mounts every disk_layout partition into the chroot, in
+// dependency order (root first, then its children by path depth), so
+// chroot_mounts is left purely for bind mounts like /proc and /dev.
+type StepMountPartitions struct {
+	Config    DiskLayoutConfig
+	MountPath string
+}
+
+func (s *StepMountPartitions) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packer.Ui)
+	device := state.Get("device").(string)
+	partitionDevices := state.Get("disk_layout_partition_devices").(map[string]string)
+
+	mountPath, err := renderMountPath(s.MountPath, device)
+	if err != nil {
+		return s.halt(state, fmt.Errorf("error rendering mount_path: %s", err))
+	}
+
+	if err := runWrappedCommand(state, fmt.Sprintf("mkdir -p %s", mountPath)); err != nil {
+		return s.halt(state, fmt.Errorf("error creating mount path: %s", err))
+	}
+
+	for _, p := range sortedByMountDepth(s.Config.Partitions) {
+		partDevice := partitionDevices[p.Mountpoint]
+		hostPath := filepath.Join(mountPath, p.Mountpoint)
+
+		if err := runWrappedCommand(state, fmt.Sprintf("mkdir -p %s", hostPath)); err != nil {
+			return s.halt(state, fmt.Errorf("error creating %s: %s", hostPath, err))
+		}
+
+		ui.Say(fmt.Sprintf("Mounting %s at %s...", partDevice, hostPath))
+		if err := runWrappedCommand(state, fmt.Sprintf("mount %s %s", partDevice, hostPath)); err != nil {
+			return s.halt(state, fmt.Errorf("error mounting %s: %s", partDevice, err))
+		}
+	}
+
+	state.Put("mount_path", mountPath)
+
+	return multistep.ActionContinue
+}
+
+func (s *StepMountPartitions) halt(state multistep.StateBag, err error) multistep.StepAction {
+	ui := state.Get("ui").(packer.Ui)
+	state.Put("error", err)
+	ui.Error(err.Error())
+	return multistep.ActionHalt
+}
+
+func (s *StepMountPartitions) Cleanup(multistep.StateBag) {}
+
+// renderMountPath evaluates the `{{.Device}}` template in a mount_path
+// setting, the same way StepMountDevice does for the non-disk_layout path.
+func renderMountPath(mountPathTemplate, device string) (string, error) {
+	ictx := interpolate.Context{Data: &struct{ Device string }{Device: filepath.Base(device)}}
+	return interpolate.Render(mountPathTemplate, &ictx)
+}
+
+// sortedByMountDepth orders partitions so that "/" mounts before "/boot",
+// which mounts before "/boot/efi", and so on.
+func sortedByMountDepth(partitions []DiskPartition) []DiskPartition {
+	sorted := make([]DiskPartition, len(partitions))
+	copy(sorted, partitions)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return mountDepth(sorted[i].Mountpoint) < mountDepth(sorted[j].Mountpoint)
+	})
+	return sorted
+}
+
+// mountDepth returns 0 for "/" and the number of path components below it
+// for everything else, so "/boot" (1) sorts after "/" (0) but before
+// "/boot/efi" (2).
+func mountDepth(mountpoint string) int {
+	if mountpoint == "/" {
+		return 0
+	}
+	return strings.Count(strings.TrimPrefix(mountpoint, "/"), "/") + 1
+}
+
+// StepUnmountPartitions unmounts the partitions mounted by
+// StepMountPartitions, and closes any per-partition LUKS mappings, before
+// StepEarlyCleanup detaches the temporary disk.
+type StepUnmountPartitions struct {
+	Config DiskLayoutConfig
+}
+
+func (s *StepUnmountPartitions) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packer.Ui)
+	mountPath := state.Get("mount_path").(string)
+
+	reversed := sortedByMountDepth(s.Config.Partitions)
+	for i, j := 0, len(reversed)-1; i < j; i, j = i+1, j-1 {
+		reversed[i], reversed[j] = reversed[j], reversed[i]
+	}
+
+	for _, p := range reversed {
+		hostPath := filepath.Join(mountPath, p.Mountpoint)
+		ui.Say(fmt.Sprintf("Unmounting %s...", hostPath))
+		if err := runWrappedCommand(state, fmt.Sprintf("umount %s", hostPath)); err != nil {
+			return s.halt(state, fmt.Errorf("error unmounting %s: %s", hostPath, err))
+		}
+	}
+
+	if mappers, ok := state.GetOk("disk_layout_luks_mappers"); ok {
+		for _, mapperName := range mappers.([]string) {
+			if err := runWrappedCommand(state, fmt.Sprintf("cryptsetup luksClose %s", mapperName)); err != nil {
+				return s.halt(state, fmt.Errorf("error closing %s: %s", mapperName, err))
+			}
+		}
+	}
+
+	return multistep.ActionContinue
+}
+
+func (s *StepUnmountPartitions) halt(state multistep.StateBag, err error) multistep.StepAction {
+	ui := state.Get("ui").(packer.Ui)
+	state.Put("error", err)
+	ui.Error(err.Error())
+	return multistep.ActionHalt
+}
+
+func (s *StepUnmountPartitions) Cleanup(multistep.StateBag) {}
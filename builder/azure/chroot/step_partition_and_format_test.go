@@ -0,0 +1,123 @@
+package chroot
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSizeMiB(t *testing.T) {
+	cases := []struct {
+		size    string
+		want    int
+		wantErr bool
+	}{
+		{"512KiB", 0, false},
+		{"200MiB", 200, false},
+		{"20GiB", 20 * 1024, false},
+		{"1TiB", 1024 * 1024, false},
+		{"200MB", 0, true},
+		{"", 0, true},
+	}
+
+	for _, c := range cases {
+		got, err := parseSizeMiB(c.size)
+		if c.wantErr {
+			if err == nil {
+				t.Errorf("parseSizeMiB(%q): expected error, got %d", c.size, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseSizeMiB(%q): unexpected error: %s", c.size, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("parseSizeMiB(%q) = %d, want %d", c.size, got, c.want)
+		}
+	}
+}
+
+func TestPartitionBounds(t *testing.T) {
+	startEnd, next, err := partitionBounds(1, "200MiB")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if startEnd != "1MiB 201MiB" || next != 201 {
+		t.Errorf("partitionBounds(1, \"200MiB\") = (%q, %d), want (\"1MiB 201MiB\", 201)", startEnd, next)
+	}
+
+	startEnd, next, err = partitionBounds(201, "100%")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if startEnd != "201MiB 100%" || next != -1 {
+		t.Errorf("partitionBounds(201, \"100%%\") = (%q, %d), want (\"201MiB 100%%\", -1)", startEnd, next)
+	}
+
+	if _, _, err := partitionBounds(0, "bogus"); err == nil {
+		t.Error("partitionBounds(0, \"bogus\"): expected error, got none")
+	}
+}
+
+func TestDevicePartitionPath(t *testing.T) {
+	cases := []struct {
+		device    string
+		partition string
+		want      string
+	}{
+		{"/dev/sdc", "1", "/dev/sdc1"},
+		{"/dev/sdc", "2", "/dev/sdc2"},
+		{"/dev/nvme0n1", "1", "/dev/nvme0n1p1"},
+		{"/dev/mmcblk0", "1", "/dev/mmcblk0p1"},
+	}
+
+	for _, c := range cases {
+		got := devicePartitionPath(c.device, c.partition)
+		if got != c.want {
+			t.Errorf("devicePartitionPath(%q, %q) = %q, want %q", c.device, c.partition, got, c.want)
+		}
+	}
+}
+
+func TestSortedByMountDepth(t *testing.T) {
+	cases := []struct {
+		name string
+		in   []string
+		want []string
+	}{
+		{
+			name: "root already first",
+			in:   []string{"/", "/boot", "/boot/efi"},
+			want: []string{"/", "/boot", "/boot/efi"},
+		},
+		{
+			name: "physical creation order, root last",
+			in:   []string{"/boot/efi", "/boot", "/"},
+			want: []string{"/", "/boot", "/boot/efi"},
+		},
+		{
+			name: "boot before root",
+			in:   []string{"/boot", "/"},
+			want: []string{"/", "/boot"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			partitions := make([]DiskPartition, len(c.in))
+			for i, mp := range c.in {
+				partitions[i] = DiskPartition{Mountpoint: mp}
+			}
+
+			sorted := sortedByMountDepth(partitions)
+
+			got := make([]string, len(sorted))
+			for i, p := range sorted {
+				got[i] = p.Mountpoint
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("sortedByMountDepth(%v) = %v, want %v", c.in, got, c.want)
+			}
+		})
+	}
+}